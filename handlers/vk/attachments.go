@@ -0,0 +1,293 @@
+package vk
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/go-errors/errors"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// attachment types accepted by VK's messages API
+const (
+	attachmentTypePhoto = "photo"
+	attachmentTypeDoc   = "doc"
+	attachmentTypeAudio = "audio_message"
+	attachmentTypeVideo = "video"
+)
+
+const (
+	urlGetPhotoUploadServer = apiBaseURL + "/photos.getMessagesUploadServer.json"
+	urlGetDocUploadServer   = apiBaseURL + "/docs.getMessagesUploadServer.json"
+	urlSaveMessagesPhoto    = apiBaseURL + "/photos.saveMessagesPhoto.json"
+	urlSaveDoc              = apiBaseURL + "/docs.save.json"
+
+	paramPeerId = "peer_id"
+	paramType   = "type"
+
+	// VK documents the messages upload server as valid for roughly 24h
+	uploadServerTTL = 24 * time.Hour
+)
+
+// uploadServer is a cached upload_url for a channel/attachment type pair
+type uploadServer struct {
+	url       string
+	expiresOn time.Time
+}
+
+// uploadServerCache holds the upload_url returned by *.getMessagesUploadServer so that we
+// don't pay for a round-trip per attachment. Keyed by "<channel uuid>:<attachment type>".
+var uploadServerCache sync.Map
+
+func uploadServerCacheKey(channel courier.Channel, attachmentType string) string {
+	return fmt.Sprintf("%s:%s", channel.UUID(), attachmentType)
+}
+
+// attachmentTypeForContentType maps an incoming MIME type to the VK attachment type used
+// to pick the right upload server and save call.
+func attachmentTypeForContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image"):
+		return attachmentTypePhoto
+	case strings.HasPrefix(contentType, "video"):
+		return attachmentTypeVideo
+	case strings.HasPrefix(contentType, "audio"):
+		return attachmentTypeAudio
+	default:
+		return attachmentTypeDoc
+	}
+}
+
+// buildMsgAttachmentsParam fetches, uploads and saves each of msg's attachments, returning
+// the comma-joined `attachment` value VK expects. Failures on individual attachments are
+// logged but don't stop the others from being attempted; an error is only returned if none of
+// the attachments could be uploaded. When every failure was a transient VK API error (see
+// isTransientVKError) that last VK error is returned as is, so callers can tell it apart.
+func buildMsgAttachmentsParam(channel courier.Channel, msg courier.Msg) (string, []*courier.ChannelLog, error) {
+	attachments := msg.Attachments()
+	if len(attachments) == 0 {
+		return "", nil, nil
+	}
+
+	var logs []*courier.ChannelLog
+	var uploaded []string
+	var lastErr error
+	allTransient := true
+
+	for i, attachment := range attachments {
+		attachmentId, attachmentLogs, err := uploadAttachment(channel, msg, attachment)
+		logs = append(logs, attachmentLogs...)
+
+		if err != nil {
+			logrus.WithField("channel_uuid", channel.UUID()).WithField("msg_id", msg.ID()).
+				WithError(err).Errorf("error uploading attachment %d/%d", i+1, len(attachments))
+			lastErr = err
+			if !isTransientVKError(err) {
+				allTransient = false
+			}
+			continue
+		}
+		uploaded = append(uploaded, attachmentId)
+	}
+
+	if len(uploaded) == 0 {
+		if allTransient {
+			return "", logs, lastErr
+		}
+		return "", logs, errors.Errorf("unable to upload any of the %d attachment(s)", len(attachments))
+	}
+
+	if len(uploaded) != len(attachments) {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("msg_id", msg.ID()).
+			Warnf("only %d of %d attachments uploaded successfully", len(uploaded), len(attachments))
+	}
+
+	return strings.Join(uploaded, ","), logs, nil
+}
+
+// uploadAttachment runs the full three-step VK upload flow for a single attachment and
+// returns the `type<owner_id>_<media_id>` string to pass in the `attachment` send param.
+func uploadAttachment(channel courier.Channel, msg courier.Msg, attachment string) (string, []*courier.ChannelLog, error) {
+	var logs []*courier.ChannelLog
+
+	contentType, attachmentURL := handlers.SplitAttachment(attachment)
+	attachmentType := attachmentTypeForContentType(contentType)
+
+	uploadURL, uploadLogs, err := getUploadServer(channel, msg, attachmentType)
+	logs = append(logs, uploadLogs...)
+	if err != nil {
+		return "", logs, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, attachmentURL, nil)
+	if err != nil {
+		return "", logs, errors.Errorf("unable to create request for attachment: %s", err)
+	}
+	mediaRR, err := utils.MakeHTTPRequest(req)
+	logs = append(logs, courier.NewChannelLogFromRR("Attachment Fetch", channel, msg.ID(), mediaRR).WithError("Attachment Fetch Error", err))
+	if err != nil {
+		return "", logs, err
+	}
+
+	uploadRR, err := postAttachmentFile(uploadURL, attachmentType, mediaRR.Body)
+	logs = append(logs, courier.NewChannelLogFromRR("Attachment Upload", channel, msg.ID(), uploadRR).WithError("Attachment Upload Error", err))
+	if err != nil {
+		return "", logs, err
+	}
+
+	attachmentId, saveLogs, err := saveUploadedAttachment(channel, msg, attachmentType, uploadRR.Body)
+	logs = append(logs, saveLogs...)
+	if err != nil {
+		return "", logs, err
+	}
+
+	return attachmentId, logs, nil
+}
+
+// getUploadServer returns the upload_url to POST the attachment bytes to, using the cached
+// value when it's still within its documented TTL.
+func getUploadServer(channel courier.Channel, msg courier.Msg, attachmentType string) (string, []*courier.ChannelLog, error) {
+	key := uploadServerCacheKey(channel, attachmentType)
+
+	if cached, ok := uploadServerCache.Load(key); ok {
+		server := cached.(*uploadServer)
+		if time.Now().Before(server.expiresOn) {
+			return server.url, nil, nil
+		}
+	}
+
+	requestURL := urlGetPhotoUploadServer
+	if attachmentType != attachmentTypePhoto {
+		requestURL = urlGetDocUploadServer
+	}
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return "", nil, errors.Errorf("unable to create upload server request: %s", err)
+	}
+	params := buildApiBaseParams(channel)
+	params.Set(paramPeerId, msg.URN().Path())
+	if attachmentType != attachmentTypePhoto {
+		params.Set(paramType, attachmentType)
+	}
+	req.URL.RawQuery = params.Encode()
+
+	rr, logs, err := callVKAPI(channel, msg.ID(), "Get Upload Server", req)
+	if err != nil {
+		return "", logs, err
+	}
+
+	uploadURL, err := jsonparser.GetString(rr.Body, responseOutgoingMessageKey, "upload_url")
+	if err != nil {
+		return "", logs, errors.Errorf("no 'upload_url' value in response: %s", err)
+	}
+
+	uploadServerCache.Store(key, &uploadServer{url: uploadURL, expiresOn: time.Now().Add(uploadServerTTL)})
+
+	return uploadURL, logs, nil
+}
+
+// postAttachmentFile POSTs the media bytes to the upload server as multipart form data, the
+// field name depending on the attachment type VK expects for that upload server.
+func postAttachmentFile(uploadURL string, attachmentType string, media []byte) (*utils.RequestResponse, error) {
+	fieldName := "file"
+	if attachmentType == attachmentTypePhoto {
+		fieldName = "photo"
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(fieldName, fieldName)
+	if err != nil {
+		return nil, errors.Errorf("unable to create multipart file: %s", err)
+	}
+	if _, err := part.Write(media); err != nil {
+		return nil, errors.Errorf("unable to write multipart file: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Errorf("unable to close multipart writer: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL, body)
+	if err != nil {
+		return nil, errors.Errorf("unable to create upload request: %s", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return utils.MakeHTTPRequest(req)
+}
+
+// saveUploadedAttachment exchanges the tokens returned by the upload server for the final
+// `type<owner_id>_<media_id>` attachment reference.
+func saveUploadedAttachment(channel courier.Channel, msg courier.Msg, attachmentType string, uploadResponse []byte) (string, []*courier.ChannelLog, error) {
+	switch attachmentType {
+	case attachmentTypePhoto:
+		server, _ := jsonparser.GetString(uploadResponse, "server")
+		photo, _ := jsonparser.GetString(uploadResponse, "photo")
+		hash, _ := jsonparser.GetString(uploadResponse, "hash")
+
+		params := buildApiBaseParams(channel)
+		params.Set("server", server)
+		params.Set("photo", photo)
+		params.Set("hash", hash)
+
+		req, err := http.NewRequest(http.MethodPost, urlSaveMessagesPhoto, nil)
+		if err != nil {
+			return "", nil, errors.Errorf("unable to create save photo request: %s", err)
+		}
+		req.URL.RawQuery = params.Encode()
+
+		rr, logs, err := callVKAPI(channel, msg.ID(), "Save Photo", req)
+		if err != nil {
+			return "", logs, err
+		}
+
+		ownerId, err := jsonparser.GetInt(rr.Body, responseOutgoingMessageKey, "[0]", "owner_id")
+		if err != nil {
+			return "", logs, errors.Errorf("no 'owner_id' value in save photo response: %s", err)
+		}
+		mediaId, err := jsonparser.GetInt(rr.Body, responseOutgoingMessageKey, "[0]", "id")
+		if err != nil {
+			return "", logs, errors.Errorf("no 'id' value in save photo response: %s", err)
+		}
+
+		return fmt.Sprintf("%s%d_%d", attachmentTypePhoto, ownerId, mediaId), logs, nil
+
+	default:
+		file, _ := jsonparser.GetString(uploadResponse, "file")
+
+		params := buildApiBaseParams(channel)
+		params.Set("file", file)
+
+		req, err := http.NewRequest(http.MethodPost, urlSaveDoc, nil)
+		if err != nil {
+			return "", nil, errors.Errorf("unable to create save doc request: %s", err)
+		}
+		req.URL.RawQuery = params.Encode()
+
+		rr, logs, err := callVKAPI(channel, msg.ID(), "Save Doc", req)
+		if err != nil {
+			return "", logs, err
+		}
+
+		ownerId, err := jsonparser.GetInt(rr.Body, responseOutgoingMessageKey, "doc", "owner_id")
+		if err != nil {
+			return "", logs, errors.Errorf("no 'owner_id' value in save doc response: %s", err)
+		}
+		mediaId, err := jsonparser.GetInt(rr.Body, responseOutgoingMessageKey, "doc", "id")
+		if err != nil {
+			return "", logs, errors.Errorf("no 'id' value in save doc response: %s", err)
+		}
+
+		return fmt.Sprintf("%s%d_%d", attachmentTypeDoc, ownerId, mediaId), logs, nil
+	}
+}
@@ -0,0 +1,96 @@
+package vk
+
+import (
+	"encoding/json"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	configSendInlineKeyboard = "send_inline_keyboard"
+	configKeyboardColor      = "keyboard_color"
+
+	defaultKeyboardColor = "secondary"
+
+	paramKeyboard = "keyboard"
+
+	keyboardButtonsPerRow = 4
+	keyboardMaxRows       = 10
+
+	actionTypeText = "text"
+)
+
+// vkKeyboard is the `keyboard` send param VK expects, see
+// https://vk.com/dev/bots_docs_3
+type vkKeyboard struct {
+	OneTime bool                 `json:"one_time,omitempty"`
+	Inline  bool                 `json:"inline,omitempty"`
+	Buttons [][]vkKeyboardButton `json:"buttons"`
+}
+
+type vkKeyboardButton struct {
+	Action vkKeyboardAction `json:"action"`
+	Color  string           `json:"color,omitempty"`
+}
+
+type vkKeyboardAction struct {
+	Type    string `json:"type"`
+	Label   string `json:"label"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// buildKeyboardParam turns msg's quick replies into the JSON `keyboard` param VK expects,
+// wrapping at keyboardButtonsPerRow buttons per row and truncating at keyboardMaxRows rows.
+// Returns an empty string if msg has no quick replies.
+func buildKeyboardParam(channel courier.Channel, msg courier.Msg) string {
+	replies := msg.QuickReplies()
+	if len(replies) == 0 {
+		return ""
+	}
+
+	color := channel.StringConfigForKey(configKeyboardColor, defaultKeyboardColor)
+	inline := channel.BoolConfigForKey(configSendInlineKeyboard, false)
+
+	maxButtons := keyboardButtonsPerRow * keyboardMaxRows
+	if len(replies) > maxButtons {
+		logrus.WithField("channel_uuid", channel.UUID()).
+			Warnf("truncating %d quick replies to the %d VK supports", len(replies), maxButtons)
+		replies = replies[:maxButtons]
+	}
+
+	keyboard := vkKeyboard{OneTime: !inline, Inline: inline}
+	var row []vkKeyboardButton
+
+	for _, reply := range replies {
+		row = append(row, vkKeyboardButton{
+			Action: vkKeyboardAction{Type: actionTypeText, Label: reply, Payload: quickReplyPayload(reply)},
+			Color:  color,
+		})
+		if len(row) == keyboardButtonsPerRow {
+			keyboard.Buttons = append(keyboard.Buttons, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		keyboard.Buttons = append(keyboard.Buttons, row)
+	}
+
+	asJSON, err := json.Marshal(keyboard)
+	if err != nil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithError(err).Error("error marshalling VK keyboard")
+		return ""
+	}
+
+	return string(asJSON)
+}
+
+// quickReplyPayload encodes a quick reply's value as the JSON string VK will echo back
+// unchanged on message_new once the button is pressed, so flows can route on it.
+func quickReplyPayload(reply string) string {
+	asJSON, err := json.Marshal(reply)
+	if err != nil {
+		return ""
+	}
+	return string(asJSON)
+}
@@ -0,0 +1,151 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/go-errors/errors"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	configRateLimit = "rate_limit"
+
+	defaultRateLimit = 20
+	defaultRateBurst = 5
+
+	// VK error codes that warrant special handling, see https://vk.com/dev/errors
+	vkErrorCodeAuth            = 5
+	vkErrorCodeTooManyRequests = 6
+	vkErrorCodeInternal        = 10
+	vkErrorCodeAccessDenied    = 15
+
+	maxRetryAttempts = 3
+	initialBackoff   = time.Second
+)
+
+// vkAPIError is returned by callVKAPI for a VK-side API error (as opposed to a network or
+// request-building failure), so callers can tell permanent failures (e.g. auth, access denied)
+// apart from a transient condition like rate limiting that merely exhausted its retries and
+// should be left for courier's normal message-retry handling rather than failed outright.
+type vkAPIError struct {
+	Code    int
+	Message string
+}
+
+func (e *vkAPIError) Error() string {
+	return fmt.Sprintf("VK API error %d: %s", e.Code, e.Message)
+}
+
+// isTransientVKError reports whether err is a vkAPIError for one of VK's documented transient
+// codes (6 - too many requests, 10 - internal error) that merely ran out of retries, as opposed
+// to a permanent failure that should fail the message outright.
+func isTransientVKError(err error) bool {
+	apiErr, ok := err.(*vkAPIError)
+	if !ok {
+		return false
+	}
+	return apiErr.Code == vkErrorCodeTooManyRequests || apiErr.Code == vkErrorCodeInternal
+}
+
+// channelLimiters holds one *rate.Limiter per channel so that every channel gets its own limit,
+// read from its rate_limit config (default 20 requests/sec, VK's documented per-community-token
+// limit), instead of sharing a process-wide one.
+var channelLimiters sync.Map
+
+func limiterForChannel(channel courier.Channel) *rate.Limiter {
+	key := string(channel.UUID())
+
+	if limiter, ok := channelLimiters.Load(key); ok {
+		return limiter.(*rate.Limiter)
+	}
+
+	rps := channel.IntConfigForKey(configRateLimit, defaultRateLimit)
+	limiter := rate.NewLimiter(rate.Limit(rps), defaultRateBurst)
+	actual, _ := channelLimiters.LoadOrStore(key, limiter)
+
+	return actual.(*rate.Limiter)
+}
+
+// callVKAPI waits on the channel's rate limiter, executes req, and retries on VK's transient
+// error codes (6 - rate limited, 10 - internal error) with exponential backoff, making at most
+// maxRetryAttempts attempts in all. Auth (5) and access denied (15) errors short-circuit immediately since
+// retrying them can never succeed. This should wrap every call to api.vk.com/method/*, including
+// the ones made from retrieveUser, so that throttling shows up in the channel log instead of
+// bubbling up as a generic send failure.
+func callVKAPI(channel courier.Channel, msgID courier.MsgID, description string, req *http.Request) (*utils.RequestResponse, []*courier.ChannelLog, error) {
+	var logs []*courier.ChannelLog
+	backoff := initialBackoff
+
+	for attempt := 1; attempt <= maxRetryAttempts; attempt++ {
+		if err := limiterForChannel(channel).Wait(context.Background()); err != nil {
+			return nil, logs, errors.Errorf("error waiting on rate limiter: %s", err)
+		}
+
+		attemptReq := req
+		if attempt > 1 {
+			cloned, err := cloneRequest(req)
+			if err != nil {
+				return nil, logs, err
+			}
+			attemptReq = cloned
+		}
+
+		rr, err := utils.MakeHTTPRequest(attemptReq)
+		log := courier.NewChannelLogFromRR(fmt.Sprintf("%s (attempt %d)", description, attempt), channel, msgID, rr).WithError(description+" Error", err)
+		logs = append(logs, log)
+
+		if err != nil {
+			return rr, logs, err
+		}
+
+		code, _ := jsonparser.GetInt(rr.Body, "error", "error_code")
+		if code == 0 {
+			return rr, logs, nil
+		}
+
+		apiErrMessage, _ := jsonparser.GetString(rr.Body, "error", "error_msg")
+
+		switch int(code) {
+		case vkErrorCodeAuth, vkErrorCodeAccessDenied:
+			return rr, logs, &vkAPIError{Code: int(code), Message: apiErrMessage}
+
+		case vkErrorCodeTooManyRequests, vkErrorCodeInternal:
+			if attempt == maxRetryAttempts {
+				return rr, logs, &vkAPIError{Code: int(code), Message: fmt.Sprintf("%s (gave up after %d attempts)", apiErrMessage, maxRetryAttempts)}
+			}
+			logrus.WithField("channel_uuid", channel.UUID()).
+				Warnf("VK API error %d, retrying in %s (attempt %d/%d)", code, backoff, attempt, maxRetryAttempts)
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+
+		default:
+			return rr, logs, &vkAPIError{Code: int(code), Message: apiErrMessage}
+		}
+	}
+
+	return nil, logs, errors.New("exhausted retry attempts")
+}
+
+// cloneRequest rebuilds req so it can be resent on retry, rewinding its body if it has one
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, errors.Errorf("unable to rewind request body for retry: %s", err)
+		}
+		clone.Body = body
+	}
+
+	return clone, nil
+}
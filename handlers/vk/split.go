@@ -0,0 +1,84 @@
+package vk
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxMessageRunes is VK's 4096 UTF-16 code unit limit on messages.send bodies, given some
+// headroom since a handful of runes (e.g. emoji) encode as surrogate pairs.
+const maxMessageRunes = 4000
+
+// messageSplitBoundaries are tried in order: paragraph, then sentence, then word. Whichever is
+// the first boundary actually present in an oversized piece of text is used to split it.
+var messageSplitBoundaries = []string{"\n\n", ". ", " "}
+
+// splitMessage breaks text into chunks of at most maxMessageRunes runes, preferring to split on
+// paragraph, then sentence, then word boundaries so that a single send reads naturally. A chunk
+// that still doesn't fit after exhausting all boundaries (e.g. one huge word) is hard split.
+func splitMessage(text string) []string {
+	return splitOnBoundaries(text, maxMessageRunes, messageSplitBoundaries)
+}
+
+func splitOnBoundaries(text string, limit int, boundaries []string) []string {
+	if utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+	if len(boundaries) == 0 {
+		return splitByRuneCount(text, limit)
+	}
+
+	sep := boundaries[0]
+	parts := strings.Split(text, sep)
+	if len(parts) < 2 {
+		return splitOnBoundaries(text, limit, boundaries[1:])
+	}
+
+	var chunks []string
+	current := ""
+
+	for i, part := range parts {
+		piece := part
+		if i < len(parts)-1 {
+			piece += sep
+		}
+
+		if utf8.RuneCountInString(piece) > limit {
+			if current != "" {
+				chunks = append(chunks, current)
+				current = ""
+			}
+			chunks = append(chunks, splitOnBoundaries(piece, limit, boundaries[1:])...)
+			continue
+		}
+
+		if current != "" && utf8.RuneCountInString(current)+utf8.RuneCountInString(piece) > limit {
+			chunks = append(chunks, current)
+			current = piece
+		} else {
+			current += piece
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+// splitByRuneCount hard-splits text into limit-rune chunks as a last resort
+func splitByRuneCount(text string, limit int) []string {
+	runes := []rune(text)
+	var chunks []string
+
+	for len(runes) > 0 {
+		n := limit
+		if n > len(runes) {
+			n = len(runes)
+		}
+		chunks = append(chunks, string(runes[:n]))
+		runes = runes[n:]
+	}
+
+	return chunks
+}
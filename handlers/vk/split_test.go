@@ -0,0 +1,76 @@
+package vk
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessageShortTextIsUnchanged(t *testing.T) {
+	text := "just a short reply"
+	chunks := splitMessage(text)
+
+	if len(chunks) != 1 || chunks[0] != text {
+		t.Fatalf("expected a single unchanged chunk, got %#v", chunks)
+	}
+}
+
+func TestSplitMessageSplitsOnParagraphBoundary(t *testing.T) {
+	paragraph := strings.Repeat("a", maxMessageRunes-10) + "\n\n" + strings.Repeat("b", maxMessageRunes-10)
+	chunks := splitMessage(paragraph)
+
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d: %#v", len(chunks), chunks)
+	}
+	for _, chunk := range chunks {
+		if utf8.RuneCountInString(chunk) > maxMessageRunes {
+			t.Fatalf("chunk exceeds maxMessageRunes: %d runes", utf8.RuneCountInString(chunk))
+		}
+	}
+	if joined := strings.Join(chunks, ""); joined != paragraph {
+		t.Fatalf("splitting lost or altered text:\nwant %q\ngot  %q", paragraph, joined)
+	}
+}
+
+func TestSplitMessageFallsBackToSentenceThenWordBoundary(t *testing.T) {
+	// no paragraph breaks, but plenty of sentences
+	sentence := strings.Repeat("word ", 900) + ". "
+	text := strings.Repeat(sentence, 5)
+
+	chunks := splitMessage(text)
+
+	if len(chunks) < 2 {
+		t.Fatalf("expected text over the limit to be split into multiple chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if utf8.RuneCountInString(chunk) > maxMessageRunes {
+			t.Fatalf("chunk %d exceeds maxMessageRunes: %d runes", i, utf8.RuneCountInString(chunk))
+		}
+	}
+	if joined := strings.Join(chunks, ""); joined != text {
+		t.Fatalf("splitting lost or altered text")
+	}
+}
+
+func TestSplitMessageHardSplitsAWordWithNoBoundaries(t *testing.T) {
+	text := strings.Repeat("x", maxMessageRunes+500)
+	chunks := splitMessage(text)
+
+	if len(chunks) != 2 {
+		t.Fatalf("expected a hard split into 2 chunks, got %d", len(chunks))
+	}
+	if utf8.RuneCountInString(chunks[0]) != maxMessageRunes {
+		t.Fatalf("expected first chunk to be exactly maxMessageRunes, got %d", utf8.RuneCountInString(chunks[0]))
+	}
+	if joined := strings.Join(chunks, ""); joined != text {
+		t.Fatalf("hard split lost or altered text")
+	}
+}
+
+func TestSplitMessageEmptyText(t *testing.T) {
+	chunks := splitMessage("")
+
+	if len(chunks) != 1 || chunks[0] != "" {
+		t.Fatalf("expected a single empty chunk for empty text, got %#v", chunks)
+	}
+}
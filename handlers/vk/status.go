@@ -0,0 +1,85 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+// body of a message_reply event, sent by VK as an echo of a message we sent out
+type moMessageReplyPayload struct {
+	Object struct {
+		Message struct {
+			Id       int64 `json:"id" validate:"required"`
+			RandomId int64 `json:"random_id"`
+			PeerId   int64 `json:"peer_id"`
+		} `json:"message" validate:"required"`
+	} `json:"object" validate:"required"`
+}
+
+// body of a message_allow event, sent when a user allows community messages
+type moMessageAllowPayload struct {
+	Object struct {
+		UserId int64  `json:"user_id" validate:"required"`
+		Key    string `json:"key"`
+	} `json:"object" validate:"required"`
+}
+
+// body of a message_deny event, sent when a user revokes community messages
+type moMessageDenyPayload struct {
+	Object struct {
+		UserId int64 `json:"user_id" validate:"required"`
+	} `json:"object" validate:"required"`
+}
+
+// receiveMessageReply handles the echo VK sends for a message we sent, confirming delivery
+func (h *handler) receiveMessageReply(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moMessageReplyPayload) ([]courier.Event, error) {
+	externalId := strconv.FormatInt(payload.Object.Message.Id, 10)
+	status := h.Backend().NewMsgStatusForExternalID(channel, externalId, courier.MsgDelivered)
+
+	if err := h.Backend().WriteMsgStatus(ctx, status); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	_, err := fmt.Fprint(w, responseIncomingMessage)
+
+	return []courier.Event{status}, err
+}
+
+// receiveMessageEdit handles a message_edit event, treating the edit as an updated incoming message
+func (h *handler) receiveMessageEdit(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moNewMessagePayload) ([]courier.Event, error) {
+	return h.receiveMessage(ctx, channel, w, r, payload)
+}
+
+// receiveMessageAllow handles a message_allow event by clearing the contact's stopped state
+// through the backend. VK fires this both when a user sends a message (which would un-stop them
+// anyway once we write it) and when they grant permission through the "allow messages" UI with
+// no accompanying message, so we can't rely on the former case alone.
+func (h *handler) receiveMessageAllow(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moMessageAllowPayload) ([]courier.Event, error) {
+	urn := urns.URN(fmt.Sprintf("%s:%d", scheme, payload.Object.UserId))
+
+	if err := h.Backend().UnstopMsgContact(ctx, urn); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	_, err := fmt.Fprint(w, responseIncomingMessage)
+
+	return nil, err
+}
+
+// receiveMessageDeny handles a message_deny event by durably marking the contact as stopped
+// through the backend, so every courier instance (not just the one that handled this callback)
+// refuses to send to them until they message_allow again.
+func (h *handler) receiveMessageDeny(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moMessageDenyPayload) ([]courier.Event, error) {
+	urn := urns.URN(fmt.Sprintf("%s:%d", scheme, payload.Object.UserId))
+
+	if err := h.Backend().StopMsgContact(ctx, urn); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	_, err := fmt.Fprint(w, responseIncomingMessage)
+
+	return nil, err
+}
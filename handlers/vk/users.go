@@ -0,0 +1,46 @@
+package vk
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/buger/jsonparser"
+	"github.com/go-errors/errors"
+	"github.com/nyaruka/courier"
+)
+
+const (
+	urlGetUser   = apiBaseURL + "/users.get.json"
+	paramUserIds = "user_ids"
+)
+
+// vkUser is the subset of users.get's response we care about
+type vkUser struct {
+	FirstName string
+	LastName  string
+}
+
+// retrieveUser looks up a VK user's name for use as the contact name on incoming messages,
+// going through callVKAPI so this call is rate limited and retried the same as any other.
+func retrieveUser(channel courier.Channel, userId int64) (*vkUser, error) {
+	req, err := http.NewRequest(http.MethodGet, urlGetUser, nil)
+	if err != nil {
+		return nil, errors.Errorf("unable to create get user request: %s", err)
+	}
+	params := buildApiBaseParams(channel)
+	params.Set(paramUserIds, strconv.FormatInt(userId, 10))
+	req.URL.RawQuery = params.Encode()
+
+	rr, _, err := callVKAPI(channel, courier.NilMsgID, "Get User", req)
+	if err != nil {
+		return nil, err
+	}
+
+	firstName, err := jsonparser.GetString(rr.Body, responseOutgoingMessageKey, "[0]", "first_name")
+	if err != nil {
+		return nil, errors.Errorf("no 'first_name' value in get user response: %s", err)
+	}
+	lastName, _ := jsonparser.GetString(rr.Body, responseOutgoingMessageKey, "[0]", "last_name")
+
+	return &vkUser{FirstName: firstName, LastName: lastName}, nil
+}
@@ -9,12 +9,12 @@ import (
 	"github.com/go-errors/errors"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
-	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -25,6 +25,11 @@ const (
 	// callback API events
 	eventTypeServerVerification = "confirmation"
 	eventTypeNewMessage         = "message_new"
+	eventTypeMessageReply       = "message_reply"
+	eventTypeMessageEdit        = "message_edit"
+	eventTypeMessageAllow       = "message_allow"
+	eventTypeMessageDeny        = "message_deny"
+	eventTypeMessageTyping      = "message_typing_state"
 
 	configServerVerificationString = "callback_verification_string"
 
@@ -64,6 +69,15 @@ func (h *handler) Initialize(s courier.Server) error {
 	return nil
 }
 
+// buildApiBaseParams builds the `v`/`access_token` param set every VK API call needs
+func buildApiBaseParams(channel courier.Channel) url.Values {
+	params := url.Values{}
+	params.Set(paramApiVersion, apiVersion)
+	params.Set(paramAccessToken, channel.StringConfigForKey(courier.ConfigAuthToken, ""))
+
+	return params
+}
+
 // base body of callback API event
 type moPayload struct {
 	Type      string `json:"type"   validate:"required"`
@@ -79,6 +93,7 @@ type moNewMessagePayload struct {
 			UserId      int64           `json:"from_id" validate:"required"`
 			Text        string          `json:"text"`
 			Attachments json.RawMessage `json:"attachments"`
+			Payload     string          `json:"payload"`
 			Geo         struct {
 				Coords struct {
 					Lat float64 `json:"latitude"`
@@ -123,6 +138,43 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 		}
 		return h.receiveMessage(ctx, channel, w, r, newMessage)
 
+	case eventTypeMessageReply:
+		reply := &moMessageReplyPayload{}
+
+		if err := handlers.DecodeAndValidateJSON(reply, r); err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		return h.receiveMessageReply(ctx, channel, w, r, reply)
+
+	case eventTypeMessageEdit:
+		edit := &moNewMessagePayload{}
+
+		if err := handlers.DecodeAndValidateJSON(edit, r); err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		return h.receiveMessageEdit(ctx, channel, w, r, edit)
+
+	case eventTypeMessageAllow:
+		allow := &moMessageAllowPayload{}
+
+		if err := handlers.DecodeAndValidateJSON(allow, r); err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		return h.receiveMessageAllow(ctx, channel, w, r, allow)
+
+	case eventTypeMessageDeny:
+		deny := &moMessageDenyPayload{}
+
+		if err := handlers.DecodeAndValidateJSON(deny, r); err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		return h.receiveMessageDeny(ctx, channel, w, r, deny)
+
+	case eventTypeMessageTyping:
+		// VK surfaces typing indicators as a best-effort courtesy event; we acknowledge the
+		// callback but don't currently turn it into a courier.Event of its own.
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring message_typing_state event")
+
 	default:
 		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring request, no message or server verification event")
 	}
@@ -158,6 +210,9 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 	if attachment := takeFirstAttachmentUrl(*payload); attachment != "" {
 		msg = msg.WithAttachment(attachment)
 	}
+	if buttonPayload := payload.Object.Message.Payload; buttonPayload != "" {
+		msg = msg.WithMetadata(json.RawMessage(buttonPayload))
+	}
 	// save message to our backend
 	if err := h.Backend().WriteMsg(ctx, msg); err != nil {
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
@@ -170,35 +225,75 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 
 func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	req, err := http.NewRequest(http.MethodPost, URLSendMessage, nil)
 
+	attachmentsParam, attachmentLogs, err := buildMsgAttachmentsParam(msg.Channel(), msg)
+	for _, l := range attachmentLogs {
+		status.AddLog(l)
+	}
 	if err != nil {
-		return status, errors.New("Cannot create send message request")
+		// a rate-limit/internal-error retry exhaustion is transient: leave the status as
+		// MsgErrored so courier's normal message-retry handling can pick it back up, rather
+		// than failing it outright
+		if !isTransientVKError(err) {
+			status.SetStatus(courier.MsgFailed)
+		}
+		return status, err
 	}
-	params := buildApiBaseParams(msg.Channel())
-	params.Set(paramUserId, msg.URN().Path())
-	params.Set(paramMessage, msg.Text())
-	params.Set(paramRandomId, msg.ID().String())
+	keyboardParam := buildKeyboardParam(msg.Channel(), msg)
 
-	// TODO
-	attachmentsParam, _ := buildMsgAttachmentsParam(msg)
-	params.Set(paramAttachments, attachmentsParam)
+	// random_id must be a VK-side unique integer, so derive one per chunk from the numeric
+	// message id rather than concatenating a suffix onto it as a string
+	baseRandomId, err := strconv.ParseInt(msg.ID().String(), 10, 64)
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		return status, errors.Errorf("unable to derive numeric random_id from message id %s: %s", msg.ID().String(), err)
+	}
+
+	chunks := splitMessage(msg.Text())
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
 
-	req.URL.RawQuery = params.Encode()
-	res, err := utils.MakeHTTPRequest(req)
+	for i, chunk := range chunks {
+		req, err := http.NewRequest(http.MethodPost, URLSendMessage, nil)
+		if err != nil {
+			return status, errors.New("Cannot create send message request")
+		}
+		params := buildApiBaseParams(msg.Channel())
+		params.Set(paramUserId, msg.URN().Path())
+		params.Set(paramMessage, chunk)
+		params.Set(paramRandomId, strconv.FormatInt(baseRandomId*1000+int64(i), 10))
+
+		// only the first chunk carries the attachments and keyboard
+		if i == 0 {
+			if attachmentsParam != "" {
+				params.Set(paramAttachments, attachmentsParam)
+			}
+			if keyboardParam != "" {
+				params.Set(paramKeyboard, keyboardParam)
+			}
+		}
 
-	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), res).WithError("Message Send Error", err)
-	status.AddLog(log)
+		req.URL.RawQuery = params.Encode()
+		res, sendLogs, err := callVKAPI(msg.Channel(), msg.ID(), fmt.Sprintf("Message Sent (chunk %d/%d)", i+1, len(chunks)), req)
+		for _, l := range sendLogs {
+			status.AddLog(l)
+		}
+		if err != nil {
+			if !isTransientVKError(err) {
+				status.SetStatus(courier.MsgFailed)
+			}
+			return status, errors.Errorf("error sending chunk %d/%d: %s", i+1, len(chunks), err)
+		}
 
-	if err != nil {
-		return status, err
+		externalMsgId, err := jsonparser.GetInt(res.Body, responseOutgoingMessageKey)
+		if err != nil {
+			status.SetStatus(courier.MsgFailed)
+			return status, errors.Errorf("no '%s' value in response for chunk %d/%d", responseOutgoingMessageKey, i+1, len(chunks))
+		}
+		status.SetExternalID(strconv.FormatInt(externalMsgId, 10))
 	}
-	externalMsgId, err := jsonparser.GetInt(res.Body, responseOutgoingMessageKey)
 
-	if err != nil {
-		return status, errors.Errorf("no '%s' value in response", responseOutgoingMessageKey)
-	}
-	status.SetExternalID(strconv.FormatInt(externalMsgId, 10))
 	status.SetStatus(courier.MsgSent)
 
 	return status, nil
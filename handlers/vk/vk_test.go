@@ -0,0 +1,116 @@
+package vk
+
+import (
+	"testing"
+
+	"github.com/nyaruka/courier"
+	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/test"
+)
+
+var testChannels = []courier.Channel{
+	test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "VK", "1234", "", map[string]interface{}{
+		courier.ConfigSecret:           "sesame",
+		courier.ConfigAuthToken:        "token123",
+		configServerVerificationString: "verify123",
+	}),
+}
+
+var handleTestCases = []ChannelHandleTestCase{
+	{
+		Label: "Receive Message", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"message_new","secret":"sesame","object":{"message":{"id":1,"date":1523942990,"from_id":123456,"text":"hello"}}}`,
+		Status: 200, Response: "ok",
+		Text: Sp("hello"), URN: Sp("vk:123456"),
+	},
+	{
+		Label: "Receive Message With Button Payload", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"message_new","secret":"sesame","object":{"message":{"id":2,"date":1523942990,"from_id":123456,"text":"yes","payload":"{\"value\":\"yes\"}"}}}`,
+		Status: 200, Response: "ok",
+		Text: Sp("yes"), URN: Sp("vk:123456"),
+	},
+	{
+		Label: "Server Verification", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"confirmation","secret":"sesame"}`,
+		Status: 200, Response: "verify123",
+	},
+	{
+		Label: "Message Reply Confirms Delivery", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"message_reply","secret":"sesame","object":{"message":{"id":55,"random_id":1,"peer_id":123456}}}`,
+		Status: 200, Response: "ok",
+	},
+	{
+		Label: "Message Deny Stops The Contact", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"message_deny","secret":"sesame","object":{"user_id":123456}}`,
+		Status: 200, Response: "ok",
+	},
+	{
+		Label: "Message Allow", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"message_allow","secret":"sesame","object":{"user_id":123456,"key":"abc"}}`,
+		Status: 200, Response: "ok",
+	},
+	{
+		Label: "Unknown Event Is Ignored", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"some_unhandled_event","secret":"sesame"}`,
+		Status: 200,
+	},
+	{
+		Label: "Wrong Secret", URL: "/c/vk/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive",
+		Data:   `{"type":"message_new","secret":"wrong","object":{"message":{"id":1,"date":1523942990,"from_id":123456,"text":"hello"}}}`,
+		Status: 400,
+	},
+}
+
+func TestHandler(t *testing.T) {
+	RunChannelTestCases(t, testChannels, newHandler(), handleTestCases)
+}
+
+var defaultSendTestCases = []SendTestCase{
+	{
+		Label: "Plain Text Send", Text: "Simple Message", URN: "vk:123456",
+		Status: "W", ExternalID: "100",
+		ResponseBody: `{"response": 100}`, ResponseStatus: 200,
+		RequestBody: "",
+	},
+	{
+		Label: "Send With Quick Replies", Text: "What now?", URN: "vk:123456",
+		QuickReplies: []string{"Yes", "No", "Maybe", "Later", "Never"},
+		Status:       "W", ExternalID: "101",
+		ResponseBody: `{"response": 101}`, ResponseStatus: 200,
+	},
+	{
+		Label: "Send With Attachment", Text: "", URN: "vk:123456",
+		Attachments: []string{"image/jpeg:https://example.com/image.jpg"},
+		Status:      "W", ExternalID: "102",
+		ResponseBody: `{"response": 102}`, ResponseStatus: 200,
+	},
+	{
+		Label: "Long Text Is Split Into An Ordered Sequence", URN: "vk:123456",
+		Text:   sendTestLongText,
+		Status: "W", ExternalID: "104",
+		ResponseBody: `{"response": 104}`, ResponseStatus: 200,
+	},
+	{
+		Label: "VK Rejects The Send", Text: "hello", URN: "vk:123456",
+		Status:       "E",
+		ResponseBody: `{"error": {"error_code": 100, "error_msg": "One of the parameters specified was missing or invalid"}}`, ResponseStatus: 200,
+	},
+	{
+		Label: "VK Auth Error Fails Immediately", Text: "hello", URN: "vk:123456",
+		Status:       "F",
+		ResponseBody: `{"error": {"error_code": 5, "error_msg": "User authorization failed"}}`, ResponseStatus: 200,
+	},
+}
+
+// sendTestLongText is long enough to require splitMessage to break it into more than one chunk
+var sendTestLongText = func() string {
+	text := ""
+	for len(text) < maxMessageRunes*2 {
+		text += "this is a long paragraph that keeps going and going.\n\n"
+	}
+	return text
+}()
+
+func TestSending(t *testing.T) {
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), defaultSendTestCases, nil)
+}